@@ -0,0 +1,178 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package personality
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/transparency-dev/formats/log"
+	"golang.org/x/mod/sumdb/note"
+)
+
+var (
+	publicationInterval = flag.Duration("publication_interval", 10*time.Second, "the interval that stable checkpoints are rounded down to, giving witnesses a stable target to cosign")
+)
+
+// cosignedCheckpoint tracks the witness signatures collected so far for a
+// single stable checkpoint body. It is discarded once the stable checkpoint
+// rolls forward.
+type cosignedCheckpoint struct {
+	body string
+	sigs map[uint32]note.Signature
+}
+
+// GetStableChkpt gets the most recent checkpoint whose timestamp has been
+// rounded down to the configured publication interval, so that witnesses
+// have a stable target to cosign rather than chasing a constantly advancing
+// tree head.
+func (p *PrimaryClient) GetStableChkpt(ctx context.Context) (SignedCheckpoint, error) {
+	cp, err := p.stableCheckpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.signCheckpoint(ctx, cp)
+}
+
+// GetCosignedChkpt gets the latest stable checkpoint together with all
+// witness cosignatures collected for it so far, as a single note signed by
+// the log and every cosigning witness.
+func (p *PrimaryClient) GetCosignedChkpt(ctx context.Context) (SignedCheckpoint, error) {
+	cp, err := p.stableCheckpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cp = p.capToReplicatedFloor(ctx, cp)
+	body := string(cp.Marshal())
+
+	p.cosignMu.Lock()
+	defer p.cosignMu.Unlock()
+	p.rollCosignedLocked(body)
+
+	signers := []note.Signer{p.Signer}
+	for _, sig := range p.cosigned.sigs {
+		signers = append(signers, &staticSigner{sig: sig})
+	}
+	return note.Sign(&note.Note{Text: body}, signers...)
+}
+
+// AddCosignature verifies that sig is a valid signature over the currently
+// advertised stable checkpoint body by witnessKey, and if so records it.
+// Cosignatures are evicted once the stable checkpoint they were collected
+// for rolls forward.
+func (p *PrimaryClient) AddCosignature(ctx context.Context, sig note.Signature, witnessKey note.Verifier) error {
+	if _, ok := p.witnesses[witnessKey.KeyHash()]; !ok {
+		return fmt.Errorf("witness %q is not in the accepted witness list", witnessKey.Name())
+	}
+
+	cp, err := p.stableCheckpoint(ctx)
+	if err != nil {
+		return err
+	}
+	cp = p.capToReplicatedFloor(ctx, cp)
+	body := string(cp.Marshal())
+
+	sigBytes, err := base64.StdEncoding.DecodeString(sig.Base64)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	// note.Signature.Base64 is hash(4 bytes) || rawSig, the same wire
+	// format note.Open parses; strip the key-hash prefix before handing
+	// the raw signature to Verify, just as note.Open does.
+	if len(sigBytes) <= 4 {
+		return fmt.Errorf("signature from witness %q is too short", witnessKey.Name())
+	}
+	if !witnessKey.Verify([]byte(body), sigBytes[4:]) {
+		return fmt.Errorf("signature from witness %q does not verify over the stable checkpoint", witnessKey.Name())
+	}
+
+	p.cosignMu.Lock()
+	defer p.cosignMu.Unlock()
+	p.rollCosignedLocked(body)
+	p.cosigned.sigs[witnessKey.KeyHash()] = sig
+	return nil
+}
+
+// rollCosignedLocked resets the collected cosignatures if the advertised
+// stable checkpoint body has moved on. p.cosignMu must be held.
+func (p *PrimaryClient) rollCosignedLocked(body string) {
+	if p.cosigned != nil && p.cosigned.body == body {
+		return
+	}
+	p.cosigned = &cosignedCheckpoint{
+		body: body,
+		sigs: make(map[uint32]note.Signature),
+	}
+}
+
+// stableCheckpoint returns the most recent checkpoint whose signing
+// timestamp, rounded down to *publicationInterval, falls in a bucket that
+// has not been served before. Within a bucket it keeps returning the same
+// cached checkpoint rather than fetching a fresh one on every call, so
+// witnesses have a stable target to cosign instead of one that moves on
+// every request.
+func (p *PrimaryClient) stableCheckpoint(ctx context.Context) (*log.Checkpoint, error) {
+	cp, timestampNanos, err := p.getCheckpointWithTimestamp(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch Trillian checkpoint: %w", err)
+	}
+
+	p.stableMu.Lock()
+	defer p.stableMu.Unlock()
+	p.stableBucket, p.stableCached = nextStableCheckpoint(p.stableBucket, p.stableCached, cp, timestampNanos, *publicationInterval)
+	return p.stableCached, nil
+}
+
+// nextStableCheckpoint decides what stableCheckpoint's cache should hold
+// given the bucket/checkpoint it currently has cached and a freshly observed
+// checkpoint/timestamp: it advances to fresh only once fresh's timestamp
+// rounds down to a bucket past the cached one, otherwise it keeps serving
+// the cached checkpoint unchanged. It is factored out of stableCheckpoint so
+// the bucketing decision can be tested without a live Trillian connection.
+func nextStableCheckpoint(cachedBucket int64, cached *log.Checkpoint, fresh *log.Checkpoint, freshTimestampNanos int64, interval time.Duration) (int64, *log.Checkpoint) {
+	bucket := freshTimestampNanos / interval.Nanoseconds()
+	if cached == nil || bucket > cachedBucket {
+		return bucket, fresh
+	}
+	return cachedBucket, cached
+}
+
+// staticSigner adapts an already-produced note.Signature into a note.Signer
+// so that note.Sign can emit a single note carrying both the log signature
+// and previously collected witness cosignatures.
+type staticSigner struct {
+	sig note.Signature
+}
+
+func (s *staticSigner) Name() string    { return s.sig.Name }
+func (s *staticSigner) KeyHash() uint32 { return s.sig.Hash }
+
+// Sign returns the raw signature bytes note.Sign expects a Signer to
+// produce; it must strip the 4-byte key-hash prefix that
+// note.Signature.Base64 carries, the same prefix note.Open strips before
+// calling Verify.
+func (s *staticSigner) Sign(msg []byte) ([]byte, error) {
+	sigBytes, err := base64.StdEncoding.DecodeString(s.sig.Base64)
+	if err != nil {
+		return nil, err
+	}
+	if len(sigBytes) <= 4 {
+		return nil, fmt.Errorf("cosignature from witness %q is too short", s.sig.Name)
+	}
+	return sigBytes[4:], nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package personality
+
+import (
+	"testing"
+	"time"
+
+	"github.com/transparency-dev/formats/log"
+)
+
+func TestNextStableCheckpoint(t *testing.T) {
+	const interval = 10 * time.Second
+	cached := &log.Checkpoint{Size: 5}
+	fresh := &log.Checkpoint{Size: 9}
+
+	t.Run("nothing cached yet adopts the fresh checkpoint", func(t *testing.T) {
+		bucket, cp := nextStableCheckpoint(0, nil, fresh, 25*int64(time.Second), interval)
+		if bucket != 2 {
+			t.Fatalf("bucket = %d, want 2", bucket)
+		}
+		if cp != fresh {
+			t.Fatalf("cp = %v, want the fresh checkpoint", cp)
+		}
+	})
+
+	t.Run("same bucket keeps serving the cached checkpoint, not the fresh one", func(t *testing.T) {
+		bucket, cp := nextStableCheckpoint(2, cached, fresh, 29*int64(time.Second), interval)
+		if bucket != 2 {
+			t.Fatalf("bucket = %d, want unchanged 2", bucket)
+		}
+		if cp != cached {
+			t.Fatalf("cp = %v, want the still-cached checkpoint", cp)
+		}
+	})
+
+	t.Run("a later bucket rolls forward to the fresh checkpoint", func(t *testing.T) {
+		bucket, cp := nextStableCheckpoint(2, cached, fresh, 31*int64(time.Second), interval)
+		if bucket != 3 {
+			t.Fatalf("bucket = %d, want 3", bucket)
+		}
+		if cp != fresh {
+			t.Fatalf("cp = %v, want the fresh checkpoint", cp)
+		}
+	})
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package personality
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/transparency-dev/formats/log"
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/merkle/rfc6962"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// InclusionBundle bundles a signed checkpoint with the inclusion proof of a
+// single leaf against it, similar to the checkpoint rekor embeds in its
+// entry-upload responses, so that a caller can verify inclusion without a
+// second round trip to the log.
+type InclusionBundle struct {
+	Checkpoint SignedCheckpoint
+	LeafIndex  int64
+	Hashes     [][]byte
+}
+
+// VerifyInclusionBundle checks that entry is included at bundle.LeafIndex in
+// the tree described by bundle.Checkpoint, which must be signed by verifier.
+func VerifyInclusionBundle(bundle *InclusionBundle, entry []byte, verifier note.Verifier) error {
+	n, err := note.Open([]byte(bundle.Checkpoint), note.VerifierList(verifier))
+	if err != nil {
+		return fmt.Errorf("failed to verify checkpoint signature: %w", err)
+	}
+	var cp log.Checkpoint
+	if _, err := cp.Unmarshal([]byte(n.Text)); err != nil {
+		return fmt.Errorf("failed to parse checkpoint: %w", err)
+	}
+
+	leafHash := rfc6962.DefaultHasher.HashLeaf(entry)
+	root, err := proof.RootFromInclusionProof(rfc6962.DefaultHasher, uint64(bundle.LeafIndex), cp.Size, leafHash, bundle.Hashes)
+	if err != nil {
+		return fmt.Errorf("failed to recompute root from inclusion proof: %w", err)
+	}
+	if !bytes.Equal(root, cp.Hash) {
+		return fmt.Errorf("recomputed root %x does not match checkpoint root %x", root, cp.Hash)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package personality
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/transparency-dev/formats/log"
+	"github.com/transparency-dev/merkle/rfc6962"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// signedCheckpointForTree builds a signed checkpoint over a 2-leaf RFC 6962
+// tree containing leafA and leafB, returning it together with its verifier
+// and the proof hashes a caller would need to verify inclusion of leafA at
+// index 0.
+func signedCheckpointForTree(t *testing.T, leafA, leafB []byte) (SignedCheckpoint, note.Verifier, [][]byte) {
+	t.Helper()
+	skey, vkey, err := note.GenerateKey(rand.Reader, "test-log")
+	if err != nil {
+		t.Fatalf("note.GenerateKey: %v", err)
+	}
+	signer, err := note.NewSigner(skey)
+	if err != nil {
+		t.Fatalf("note.NewSigner: %v", err)
+	}
+	verifier, err := note.NewVerifier(vkey)
+	if err != nil {
+		t.Fatalf("note.NewVerifier: %v", err)
+	}
+
+	hashA := rfc6962.DefaultHasher.HashLeaf(leafA)
+	hashB := rfc6962.DefaultHasher.HashLeaf(leafB)
+	root := rfc6962.DefaultHasher.HashChildren(hashA, hashB)
+
+	cp := log.Checkpoint{Origin: "test log", Size: 2, Hash: root}
+	signed, err := note.Sign(&note.Note{Text: string(cp.Marshal())}, signer)
+	if err != nil {
+		t.Fatalf("note.Sign: %v", err)
+	}
+	return SignedCheckpoint(signed), verifier, [][]byte{hashB}
+}
+
+func TestVerifyInclusionBundle(t *testing.T) {
+	leafA, leafB := []byte("entry a"), []byte("entry b")
+	signed, verifier, hashes := signedCheckpointForTree(t, leafA, leafB)
+
+	bundle := &InclusionBundle{Checkpoint: signed, LeafIndex: 0, Hashes: hashes}
+	if err := VerifyInclusionBundle(bundle, leafA, verifier); err != nil {
+		t.Fatalf("VerifyInclusionBundle with a genuine proof: %v", err)
+	}
+}
+
+func TestVerifyInclusionBundleRejectsWrongEntry(t *testing.T) {
+	leafA, leafB := []byte("entry a"), []byte("entry b")
+	signed, verifier, hashes := signedCheckpointForTree(t, leafA, leafB)
+
+	bundle := &InclusionBundle{Checkpoint: signed, LeafIndex: 0, Hashes: hashes}
+	if err := VerifyInclusionBundle(bundle, []byte("not entry a"), verifier); err == nil {
+		t.Fatalf("VerifyInclusionBundle succeeded for an entry that was never included")
+	}
+}
+
+func TestVerifyInclusionBundleRejectsTamperedProof(t *testing.T) {
+	leafA, leafB := []byte("entry a"), []byte("entry b")
+	signed, verifier, hashes := signedCheckpointForTree(t, leafA, leafB)
+
+	tampered := make([][]byte, len(hashes))
+	copy(tampered, hashes)
+	tampered[0] = rfc6962.DefaultHasher.HashLeaf([]byte("not entry b"))
+
+	bundle := &InclusionBundle{Checkpoint: signed, LeafIndex: 0, Hashes: tampered}
+	if err := VerifyInclusionBundle(bundle, leafA, verifier); err == nil {
+		t.Fatalf("VerifyInclusionBundle succeeded with a tampered inclusion proof")
+	}
+}
@@ -16,14 +16,18 @@
 package personality
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/trillian"
 	tt "github.com/google/trillian/types"
 	"github.com/transparency-dev/formats/log"
+	"github.com/transparency-dev/merkle/proof"
 	"github.com/transparency-dev/merkle/rfc6962"
 	"golang.org/x/mod/sumdb/note"
 	"google.golang.org/grpc"
@@ -32,47 +36,177 @@ import (
 
 var (
 	connectTimeout = flag.Duration("connect_timeout", 5*time.Second, "the timeout for connecting to the backend")
+	witnessKeys    = flag.String("witness_keys", "", "comma-separated list of note verifier keys for witnesses whose cosignatures will be accepted")
+	maxLeavesBatch = flag.Int("max_leaves_batch", 256, "the maximum number of leaves GetLeaves will return in a single call")
 )
 
 // SignedCheckpoint is a serialised form of a checkpoint+signatures.
 type SignedCheckpoint []byte
 
-// TrillianP is a personality backed by a trillian log.
-type TrillianClient struct {
+// TrillianClient is the interface satisfied by a personality that can sign
+// and serve checkpoints for a Trillian log.
+//
+// PrimaryClient is, by design, the only implementation. A SecondaryClient
+// holds no signing key and accepts no writes, so it cannot satisfy this
+// interface and deliberately does not try to: it only replicates tree state
+// and serves its own tree head to primaries (see ReplicaServer). A caller
+// that needs to treat both roles polymorphically should not type-assert to
+// TrillianClient; there is, intentionally, only ever one concrete type on
+// the other end of it.
+type TrillianClient interface {
+	GetChkpt(ctx context.Context) (SignedCheckpoint, error)
+	GetLatestChkpt(ctx context.Context) (SignedCheckpoint, error)
+	GetStableChkpt(ctx context.Context) (SignedCheckpoint, error)
+	GetCosignedChkpt(ctx context.Context) (SignedCheckpoint, error)
+	AddCosignature(ctx context.Context, sig note.Signature, witnessKey note.Verifier) error
+	Append(ctx context.Context, entry []byte) (*InclusionBundle, error)
+	ProveIncl(ctx context.Context, chkptSize uint64, entry []byte) (*trillian.Proof, error)
+	UpdateChkpt(ctx context.Context, chkptSize uint64) (SignedCheckpoint, *trillian.Proof, error)
+	GetLeaves(ctx context.Context, startIndex, count int64) ([]*trillian.LogLeaf, error)
+	IterLeaves(ctx context.Context, start, end int64, fn func(idx int64, leaf *trillian.LogLeaf) error) error
+}
+
+// client holds the Trillian log connection shared by both the primary and
+// secondary personalities.
+type client struct {
 	LogClient trillian.TrillianLogClient
 	TreeID    int64
-	Counter   int
-	LastTag   []byte
-	Signer    note.Signer
+
+	// MaxBatchSize caps how many leaves GetLeaves will return in one call.
+	MaxBatchSize int64
 }
 
-// NewPersonality creates a new Trillian personality from the flags.
-func NewPersonality(logAddr string, treeID int64, s note.Signer) (*TrillianClient, error) {
-	if treeID <= 0 {
-		return nil, fmt.Errorf("tree_id must be provided and positive, got %d", treeID)
-	}
+// PrimaryClient is a personality backed by a Trillian log that accepts
+// writes and publishes signed checkpoints for it.
+type PrimaryClient struct {
+	client
 
+	Counter int
+	LastTag []byte
+	Signer  note.Signer
+
+	// witnesses holds the set of verifiers, keyed by KeyHash, that
+	// AddCosignature will accept cosignatures from.
+	witnesses map[uint32]note.Verifier
+
+	cosignMu sync.Mutex
+	// cosigned tracks the witness signatures collected for the current
+	// stable checkpoint, so they can be evicted once it rolls forward.
+	cosigned *cosignedCheckpoint
+
+	stableMu sync.Mutex
+	// stableBucket is the publication-interval bucket stableCached was
+	// cached for; stableCheckpoint only refreshes the cache once the
+	// current bucket moves past it.
+	stableBucket int64
+	stableCached *log.Checkpoint
+
+	secondaries  []*ReplicaClient
+	replicaGrace time.Duration
+
+	floorMu       sync.Mutex
+	lastFloor     uint64
+	haveLastFloor bool
+}
+
+// SecondaryClient is a personality backed by a Trillian log that only
+// replicates: it serves its own tree head to primaries over the Replica
+// gRPC service (see RegisterReplicaServer), but it never signs a checkpoint
+// and does not accept writes.
+type SecondaryClient struct {
+	client
+}
+
+// dialTrillian connects to a Trillian log server at logAddr.
+func dialTrillian(logAddr string) (trillian.TrillianLogClient, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), *connectTimeout)
 	defer cancel()
 	conn, err := grpc.DialContext(ctx, logAddr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
 	if err != nil {
 		return nil, fmt.Errorf("did not connect to trillian on %v: %v", logAddr, err)
 	}
+	return trillian.NewTrillianLogClient(conn), nil
+}
+
+// NewPersonality creates a new primary Trillian personality from the flags,
+// with no secondaries configured. It is retained for callers that predate
+// the primary/secondary split; new callers should use NewPrimary directly.
+func NewPersonality(logAddr string, treeID int64, s note.Signer) (*PrimaryClient, error) {
+	return NewPrimary(logAddr, treeID, s, nil)
+}
+
+// NewPrimary creates a new Trillian personality that accepts writes and
+// publishes signed checkpoints, optionally floored by the tree sizes
+// replicated by secondaries at the given addresses.
+func NewPrimary(logAddr string, treeID int64, s note.Signer, secondaries []string) (*PrimaryClient, error) {
+	if treeID <= 0 {
+		return nil, fmt.Errorf("tree_id must be provided and positive, got %d", treeID)
+	}
+
+	logClient, err := dialTrillian(logAddr)
+	if err != nil {
+		return nil, err
+	}
 
-	log := trillian.NewTrillianLogClient(conn)
-	x := &TrillianClient{
-		LogClient: log,
-		TreeID:    treeID,
-		Counter:   0,
-		LastTag:   nil,
-		Signer:    s,
+	witnesses, err := parseWitnessKeys(*witnessKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid witness_keys: %w", err)
+	}
+
+	secs := make([]*ReplicaClient, 0, len(secondaries))
+	for _, addr := range secondaries {
+		sec, err := NewReplicaClient(addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up replica client for secondary %q: %w", addr, err)
+		}
+		secs = append(secs, sec)
 	}
 
-	return x, nil
+	return &PrimaryClient{
+		client:       client{LogClient: logClient, TreeID: treeID, MaxBatchSize: int64(*maxLeavesBatch)},
+		Counter:      0,
+		LastTag:      nil,
+		Signer:       s,
+		witnesses:    witnesses,
+		secondaries:  secs,
+		replicaGrace: *replicaGraceWindow,
+	}, nil
+}
+
+// NewSecondary creates a new Trillian personality that only replicates tree
+// state from the log at logAddr; it accepts no writes and signs nothing.
+func NewSecondary(logAddr string, treeID int64) (*SecondaryClient, error) {
+	if treeID <= 0 {
+		return nil, fmt.Errorf("tree_id must be provided and positive, got %d", treeID)
+	}
+
+	logClient, err := dialTrillian(logAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecondaryClient{client: client{LogClient: logClient, TreeID: treeID, MaxBatchSize: int64(*maxLeavesBatch)}}, nil
+}
+
+// parseWitnessKeys parses a comma-separated list of note verifier keys into
+// a map keyed by KeyHash, for use as the set of accepted witnesses.
+func parseWitnessKeys(keys string) (map[uint32]note.Verifier, error) {
+	witnesses := make(map[uint32]note.Verifier)
+	if keys == "" {
+		return witnesses, nil
+	}
+	for _, k := range strings.Split(keys, ",") {
+		v, err := note.NewVerifier(strings.TrimSpace(k))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse witness key %q: %w", k, err)
+		}
+		witnesses[v.KeyHash()] = v
+	}
+	return witnesses, nil
 }
 
 // formLeaf creates a Trillian log leaf from an entry.
-func (p *TrillianClient) formLeaf(entry []byte) *trillian.LogLeaf {
+func (c *client) formLeaf(entry []byte) *trillian.LogLeaf {
 	leafHash := rfc6962.DefaultHasher.HashLeaf(entry)
 	return &trillian.LogLeaf{
 		LeafValue:      entry,
@@ -81,32 +215,95 @@ func (p *TrillianClient) formLeaf(entry []byte) *trillian.LogLeaf {
 }
 
 // getCheckpoint fetches the latest Trillian root and creates a checkpoint from it.
-func (p *TrillianClient) getCheckpoint(ctx context.Context) (*log.Checkpoint, error) {
-	req := trillian.GetLatestSignedLogRootRequest{LogId: p.TreeID}
-	resp, err := p.LogClient.GetLatestSignedLogRoot(ctx, &req)
+func (c *client) getCheckpoint(ctx context.Context) (*log.Checkpoint, error) {
+	cp, _, err := c.getCheckpointWithTimestamp(ctx)
+	return cp, err
+}
+
+// getCheckpointWithTimestamp is like getCheckpoint, but also returns the
+// timestamp Trillian signed the root at, for callers (such as
+// stableCheckpoint) that need to reason about when the root was produced
+// rather than just its content.
+func (c *client) getCheckpointWithTimestamp(ctx context.Context) (*log.Checkpoint, int64, error) {
+	req := trillian.GetLatestSignedLogRootRequest{LogId: c.TreeID}
+	resp, err := c.LogClient.GetLatestSignedLogRoot(ctx, &req)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	// Unpack the response and convert it to the local Checkpoint
 	// representation.
 	root := resp.GetSignedLogRoot()
 	var logRoot tt.LogRootV1
 	if err := logRoot.UnmarshalBinary(root.LogRoot); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	return &log.Checkpoint{
 		Origin: "Hello World Log",
 		Hash:   logRoot.RootHash,
 		Size:   logRoot.TreeSize,
-	}, nil
+	}, int64(logRoot.TimestampNanos), nil
 }
 
-// GetChkpt gets the latest checkpoint.
-func (p *TrillianClient) GetChkpt(ctx context.Context) (SignedCheckpoint, error) {
-	cp, err := p.getCheckpoint(ctx)
+// capToReplicatedFloor caps cp.Size to the minimum tree size replicated by
+// configured secondaries, so the primary never signs and publishes a
+// checkpoint that outruns its replication. If no secondaries are configured
+// it is a no-op. If every secondary is unreachable, it degrades by capping
+// at the last floor it successfully observed (or at 0, if it has never
+// observed one) rather than skipping the cap and publishing unfloored.
+//
+// cp is never mutated: callers such as stableCheckpoint may hand it a
+// checkpoint that is cached and shared with other goroutines, so capping
+// always returns either cp itself (if no cap is needed) or a capped copy.
+func (p *PrimaryClient) capToReplicatedFloor(ctx context.Context, cp *log.Checkpoint) *log.Checkpoint {
+	if len(p.secondaries) == 0 {
+		return cp
+	}
+	floor, err := p.GetReplicatedTreeSize(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch Trillian checkpoint: %w", err)
+		floor = p.lastKnownFloor()
+	} else {
+		p.setLastKnownFloor(floor)
+	}
+	return capCheckpointSize(cp, floor)
+}
+
+// capCheckpointSize returns cp unchanged if cp.Size is already at or below
+// floor, or otherwise a copy of cp with Size reduced to floor. It never
+// modifies cp itself, so it is safe to call with a checkpoint pointer shared
+// with other callers.
+func capCheckpointSize(cp *log.Checkpoint, floor uint64) *log.Checkpoint {
+	if cp.Size <= floor {
+		return cp
 	}
+	capped := *cp
+	capped.Size = floor
+	return &capped
+}
+
+// lastKnownFloor returns the last replicated floor this primary observed,
+// or 0 if it has never successfully polled a secondary.
+func (p *PrimaryClient) lastKnownFloor() uint64 {
+	p.floorMu.Lock()
+	defer p.floorMu.Unlock()
+	if !p.haveLastFloor {
+		return 0
+	}
+	return p.lastFloor
+}
+
+// setLastKnownFloor records floor as the last replicated floor this primary
+// observed, for use if secondaries later become unreachable.
+func (p *PrimaryClient) setLastKnownFloor(floor uint64) {
+	p.floorMu.Lock()
+	defer p.floorMu.Unlock()
+	p.lastFloor = floor
+	p.haveLastFloor = true
+}
+
+// signCheckpoint signs a checkpoint body with the log signer, first capping
+// its size to what configured secondaries have durably replicated.
+func (p *PrimaryClient) signCheckpoint(ctx context.Context, cp *log.Checkpoint) (SignedCheckpoint, error) {
+	cp = p.capToReplicatedFloor(ctx, cp)
 	s, err := note.Sign(&note.Note{Text: string(cp.Marshal())}, p.Signer)
 	if err != nil {
 		return nil, err
@@ -114,50 +311,111 @@ func (p *TrillianClient) GetChkpt(ctx context.Context) (SignedCheckpoint, error)
 	return s, nil
 }
 
-// Append adds an entry to the Trillian log and waits to return the new checkpoint.
-func (p *TrillianClient) Append(ctx context.Context, entry []byte) (SignedCheckpoint, error) {
-	// First get the latest checkpoint.
-	chkpt, err := p.getCheckpoint(ctx)
+// GetLatestChkpt gets the latest checkpoint, fetched fresh from Trillian.
+func (p *PrimaryClient) GetLatestChkpt(ctx context.Context) (SignedCheckpoint, error) {
+	cp, err := p.getCheckpoint(ctx)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to fetch Trillian checkpoint: %w", err)
 	}
+	return p.signCheckpoint(ctx, cp)
+}
+
+// GetChkpt gets the latest checkpoint.
+func (p *PrimaryClient) GetChkpt(ctx context.Context) (SignedCheckpoint, error) {
+	return p.GetLatestChkpt(ctx)
+}
+
+// QueueLeaf adds an entry to the Trillian log without waiting for it to be
+// sequenced.
+func (p *PrimaryClient) QueueLeaf(ctx context.Context, entry []byte) error {
+	req := trillian.QueueLeafRequest{LogId: p.TreeID, Leaf: p.formLeaf(entry)}
+	_, err := p.LogClient.QueueLeaf(ctx, &req)
+	return err
+}
+
+// Append adds an entry to the Trillian log and returns the resulting signed
+// checkpoint bundled with an inclusion proof anchoring the entry to it, so
+// callers can verify inclusion without a second round trip.
+//
+// It does not report success merely because the tree size has grown: it
+// recomputes the root from the entry's own inclusion proof and only signs
+// and returns once that root matches the observed checkpoint, which rules
+// out the entry having raced with some other, unrelated sequencing.
+func (p *PrimaryClient) Append(ctx context.Context, entry []byte) (*InclusionBundle, error) {
 	leaf := p.formLeaf(entry)
 	req := trillian.QueueLeafRequest{LogId: p.TreeID, Leaf: leaf}
 	if _, err := p.LogClient.QueueLeaf(ctx, &req); err != nil {
 		return nil, err
 	}
-	// Now fetch the new checkpoint, keep going until it's there and
-	// return an error at some point if it isn't.
-	for start := time.Now(); time.Since(start) < 5*time.Second; {
+
+	backoff := 50 * time.Millisecond
+	const maxBackoff = 500 * time.Millisecond
+	for {
 		chkptNew, err := p.getCheckpoint(ctx)
 		if err != nil {
 			return nil, err
 		}
-		// TODO(meiklejohn): should probably verify that the specific entry was
-		// incorporated into the tree too.
-		if chkpt.Size < chkptNew.Size {
-			s, err := note.Sign(&note.Note{Text: string(chkptNew.Marshal())}, p.Signer)
-			if err != nil {
-				return nil, err
-			}
-			return s, nil
+		if bundle, err := p.verifiedInclusion(ctx, leaf, chkptNew); err == nil {
+			return bundle, nil
 		}
+		// Either the leaf isn't incorporated at this tree size yet, or the
+		// recomputed root didn't match it (possible under sequencing
+		// races): keep polling until the caller's deadline.
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("did not get a verified checkpoint: %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// verifiedInclusion fetches the inclusion proof for leaf at chkptNew's tree
+// size and returns a signed InclusionBundle only if the proof's recomputed
+// root matches chkptNew's root hash.
+func (p *PrimaryClient) verifiedInclusion(ctx context.Context, leaf *trillian.LogLeaf, chkptNew *log.Checkpoint) (*InclusionBundle, error) {
+	proofReq := trillian.GetInclusionProofByHashRequest{
+		LogId:    p.TreeID,
+		LeafHash: leaf.MerkleLeafHash,
+		TreeSize: int64(chkptNew.Size),
+	}
+	proofResp, err := p.LogClient.GetInclusionProofByHash(ctx, &proofReq)
+	if err != nil {
+		return nil, fmt.Errorf("no inclusion proof yet at size %d: %w", chkptNew.Size, err)
+	}
+	incl := proofResp.GetProof()[0]
+	root, err := proof.RootFromInclusionProof(rfc6962.DefaultHasher, uint64(incl.GetLeafIndex()), chkptNew.Size, leaf.MerkleLeafHash, incl.GetHashes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to recompute root from inclusion proof: %w", err)
+	}
+	if !bytes.Equal(root, chkptNew.Hash) {
+		return nil, fmt.Errorf("recomputed root does not match checkpoint root at size %d", chkptNew.Size)
 	}
-	return nil, fmt.Errorf("did not get an updated checkpoint")
+	signed, err := p.signCheckpoint(ctx, chkptNew)
+	if err != nil {
+		return nil, err
+	}
+	return &InclusionBundle{
+		Checkpoint: signed,
+		LeafIndex:  incl.GetLeafIndex(),
+		Hashes:     incl.GetHashes(),
+	}, nil
 }
 
 // ProveIncl returns an inclusion proof for a given checkpoint and entry.
-func (p *TrillianClient) ProveIncl(ctx context.Context, chkptSize uint64, entry []byte) (*trillian.Proof, error) {
+func (c *client) ProveIncl(ctx context.Context, chkptSize uint64, entry []byte) (*trillian.Proof, error) {
 	// Form the leaf from the entry.
-	leaf := p.formLeaf(entry)
+	leaf := c.formLeaf(entry)
 	// Form the request according to the Trillian API.
 	req := trillian.GetInclusionProofByHashRequest{
-		LogId:    p.TreeID,
+		LogId:    c.TreeID,
 		LeafHash: leaf.MerkleLeafHash,
 		TreeSize: int64(chkptSize),
 	}
 	// Process the response.
-	resp, err := p.LogClient.GetInclusionProofByHash(ctx, &req)
+	resp, err := c.LogClient.GetInclusionProofByHash(ctx, &req)
 	if err != nil {
 		return nil, err
 	}
@@ -166,7 +424,7 @@ func (p *TrillianClient) ProveIncl(ctx context.Context, chkptSize uint64, entry
 
 // UpdateChkpt gets the latest checkpoint for the Trillian log and proves its
 // consistency with a provided one.
-func (p *TrillianClient) UpdateChkpt(ctx context.Context, chkptSize uint64) (SignedCheckpoint, *trillian.Proof, error) {
+func (p *PrimaryClient) UpdateChkpt(ctx context.Context, chkptSize uint64) (SignedCheckpoint, *trillian.Proof, error) {
 	// First get the latest checkpoint
 	chkptNew, err := p.getCheckpoint(ctx)
 	if err != nil {
@@ -186,7 +444,7 @@ func (p *TrillianClient) UpdateChkpt(ctx context.Context, chkptSize uint64) (Sig
 		}
 		pf = resp.GetProof()
 	}
-	s, err := note.Sign(&note.Note{Text: string(chkptNew.Marshal())}, p.Signer)
+	s, err := p.signCheckpoint(ctx, chkptNew)
 	if err != nil {
 		return nil, nil, err
 	}
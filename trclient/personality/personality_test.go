@@ -0,0 +1,48 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package personality
+
+import (
+	"testing"
+
+	"github.com/transparency-dev/formats/log"
+)
+
+func TestCapCheckpointSize(t *testing.T) {
+	orig := &log.Checkpoint{Origin: "test log", Size: 10, Hash: []byte("roothash")}
+
+	t.Run("below floor returns the same pointer unmutated", func(t *testing.T) {
+		got := capCheckpointSize(orig, 20)
+		if got != orig {
+			t.Fatalf("capCheckpointSize returned a copy when no cap was needed")
+		}
+		if got.Size != 10 {
+			t.Fatalf("Size = %d, want unchanged 10", got.Size)
+		}
+	})
+
+	t.Run("above floor returns a capped copy without mutating the original", func(t *testing.T) {
+		got := capCheckpointSize(orig, 4)
+		if got == orig {
+			t.Fatalf("capCheckpointSize must not return the original pointer when capping")
+		}
+		if got.Size != 4 {
+			t.Fatalf("Size = %d, want 4", got.Size)
+		}
+		if orig.Size != 10 {
+			t.Fatalf("capCheckpointSize mutated the original checkpoint: Size = %d, want unchanged 10", orig.Size)
+		}
+	})
+}
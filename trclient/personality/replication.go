@@ -0,0 +1,191 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package personality
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+var (
+	replicaGraceWindow = flag.Duration("replica_grace_window", 30*time.Second, "how long a primary will tolerate an unreachable secondary before degrading the floor it imposes on published checkpoint size")
+	replicaPollTimeout = flag.Duration("replica_poll_timeout", 5*time.Second, "the timeout for a single poll of a secondary's tree head")
+)
+
+// replicaServiceName is the gRPC service a SecondaryClient registers and a
+// ReplicaClient calls to discover a secondary's replicated tree size.
+const replicaServiceName = "personality.Replica"
+
+// replicaServiceDesc describes the Replica gRPC service by hand, in lieu of
+// protoc-generated stubs: its single method takes no input and returns the
+// secondary's tree size, so it's expressed entirely in terms of the
+// well-known emptypb/wrapperspb message types rather than a bespoke .proto.
+var replicaServiceDesc = grpc.ServiceDesc{
+	ServiceName: replicaServiceName,
+	HandlerType: (*ReplicaServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetTreeHead",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(emptypb.Empty)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				if interceptor == nil {
+					return srv.(ReplicaServer).GetTreeHead(ctx, in)
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + replicaServiceName + "/GetTreeHead"}
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(ReplicaServer).GetTreeHead(ctx, req.(*emptypb.Empty))
+				}
+				return interceptor(ctx, in, info, handler)
+			},
+		},
+	},
+	Metadata: "trclient/personality/replication.go",
+}
+
+// ReplicaServer is implemented by SecondaryClient to serve its replicated
+// tree size over gRPC.
+type ReplicaServer interface {
+	GetTreeHead(ctx context.Context, _ *emptypb.Empty) (*wrapperspb.UInt64Value, error)
+}
+
+// RegisterReplicaServer registers srv on s, so that ReplicaClients can poll
+// it for its replicated tree size.
+func RegisterReplicaServer(s *grpc.Server, srv ReplicaServer) {
+	s.RegisterService(&replicaServiceDesc, srv)
+}
+
+// ReplicaClient polls a SecondaryClient's GetTreeHead gRPC method so a
+// primary can discover how far a secondary has replicated.
+type ReplicaClient struct {
+	Addr string
+	conn *grpc.ClientConn
+}
+
+// NewReplicaClient creates a ReplicaClient for the secondary at addr, which
+// must be serving the Replica service registered via RegisterReplicaServer.
+// The connection is established lazily, so addr may be unreachable at
+// construction time; GetTreeHead picks it up once it comes up.
+func NewReplicaClient(addr string) (*ReplicaClient, error) {
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("did not connect to secondary on %v: %v", addr, err)
+	}
+	return &ReplicaClient{Addr: addr, conn: conn}, nil
+}
+
+// GetTreeHead fetches the secondary's latest replicated tree size.
+func (r *ReplicaClient) GetTreeHead(ctx context.Context) (uint64, error) {
+	out := new(wrapperspb.UInt64Value)
+	if err := r.conn.Invoke(ctx, "/"+replicaServiceName+"/GetTreeHead", new(emptypb.Empty), out); err != nil {
+		return 0, err
+	}
+	return out.GetValue(), nil
+}
+
+// GetTreeHead implements ReplicaServer, serving this secondary's own latest
+// (unsigned) tree size so that a primary can discover the replicated floor.
+func (s *SecondaryClient) GetTreeHead(ctx context.Context, _ *emptypb.Empty) (*wrapperspb.UInt64Value, error) {
+	cp, err := s.getCheckpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return wrapperspb.UInt64(cp.Size), nil
+}
+
+// GetReplicatedTreeSize polls all configured secondaries concurrently and
+// returns the smallest tree size any of them has confirmed replicating.
+// Secondaries that stay unreachable for longer than replicaGraceWindow are
+// dropped from the floor computation rather than causing an error, so a
+// single stuck secondary degrades the floor instead of blocking publication
+// entirely. Because every secondary is polled in its own goroutine, one
+// stuck secondary costs at most replicaGrace plus one replicaPollTimeout
+// overall (a poll may start just before the grace window ends), not that
+// multiplied by the number of secondaries.
+func (p *PrimaryClient) GetReplicatedTreeSize(ctx context.Context) (uint64, error) {
+	if len(p.secondaries) == 0 {
+		return 0, fmt.Errorf("no secondaries configured")
+	}
+
+	sizes := make([]uint64, len(p.secondaries))
+	errs := make([]error, len(p.secondaries))
+	var wg sync.WaitGroup
+	for i, sec := range p.secondaries {
+		wg.Add(1)
+		go func(i int, sec *ReplicaClient) {
+			defer wg.Done()
+			sizes[i], errs[i] = p.pollSecondaryWithBackoff(ctx, sec)
+		}(i, sec)
+	}
+	wg.Wait()
+
+	var (
+		floor     uint64
+		haveFloor bool
+	)
+	for i, err := range errs {
+		if err != nil {
+			// This secondary has been unreachable for the whole grace
+			// window: degrade by leaving it out of the floor rather than
+			// failing the whole call.
+			continue
+		}
+		if !haveFloor || sizes[i] < floor {
+			floor = sizes[i]
+			haveFloor = true
+		}
+	}
+	if !haveFloor {
+		return 0, fmt.Errorf("no secondaries were reachable within %s", p.replicaGrace)
+	}
+	return floor, nil
+}
+
+// pollSecondaryWithBackoff polls a single secondary for its tree head,
+// retrying with exponential backoff until it answers or the grace window
+// elapses.
+func (p *PrimaryClient) pollSecondaryWithBackoff(ctx context.Context, sec *ReplicaClient) (uint64, error) {
+	deadline := time.Now().Add(p.replicaGrace)
+	backoff := 50 * time.Millisecond
+	for {
+		pollCtx, cancel := context.WithTimeout(ctx, *replicaPollTimeout)
+		size, err := sec.GetTreeHead(pollCtx)
+		cancel()
+		if err == nil {
+			return size, nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return 0, fmt.Errorf("secondary %s unreachable after grace window: %w", sec.Addr, err)
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff < 500*time.Millisecond {
+			backoff *= 2
+		}
+	}
+}